@@ -0,0 +1,321 @@
+// Copyright 2020 Dale Farnsworth. All rights reserved.
+
+// Dale Farnsworth
+// 1007 W Mendoza Ave
+// Mesa, AZ  85210
+// USA
+//
+// dale@farnsworth.org
+
+// dnshole is free software: you can redistribute it and/or modify
+// it under the terms of version 3 of the GNU General Public License
+// as published by the Free Software Foundation.
+//
+// dnshole is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with dnshole.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The recognized listDesc formats.
+const (
+	formatHosts    = "hosts"
+	formatAdblock  = "adblock"
+	formatDomains  = "domains"
+	formatWildcard = "wildcard"
+	formatRegex    = "regex"
+)
+
+// listDesc contains the information needed to fetch and parse a list
+// of domains.
+type listDesc struct {
+	format     string        // One of the format* constants above.
+	url        string        // The url containing the list of domains.
+	fieldIndex int           // For formatHosts, the space separated index of the domain on a line, origin 1.
+	allowBlock int           // whether the list is a allowlist or a blocklist
+	maxAge     time.Duration // cache freshness override; 0 means always revalidate
+}
+
+// listDescs holds all of the list descripters read from the config file.
+var listDescs []listDesc
+
+// parseDomains returns the domain names from field fieldIndex on a line.
+func parseDomains(line string, fieldIndex int) []string {
+	i := strings.Index(line, "#")
+	if i >= 0 {
+		line = line[:i]
+	}
+
+	fields := strings.Fields(line)
+	if fieldIndex >= len(fields) {
+		return nil
+	}
+	return fields[fieldIndex:]
+}
+
+// parseAdblockDomain returns the domain blocked by an Adblock Plus
+// filter rule, or "" if line isn't a plain domain-blocking rule.
+// Comments (lines starting with "!"), element-hiding rules (lines
+// containing "##", "#@#", or "#?#"), and rules with path or wildcard
+// components are all skipped.
+func parseAdblockDomain(line string) string {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "!") {
+		return ""
+	}
+	if strings.Contains(line, "##") || strings.Contains(line, "#@#") || strings.Contains(line, "#?#") {
+		return ""
+	}
+	if !strings.HasPrefix(line, "||") {
+		return ""
+	}
+
+	rule := line[len("||"):]
+	if i := strings.Index(rule, "$"); i >= 0 {
+		rule = rule[:i]
+	}
+	rule = strings.TrimSuffix(rule, "^")
+
+	if strings.ContainsAny(rule, "/*") || rule == "" {
+		return ""
+	}
+
+	return rule
+}
+
+// parseDomainLine returns the domain name on a formatDomains line, or
+// "" if the line is blank or a comment.
+func parseDomainLine(line string) string {
+	i := strings.Index(line, "#")
+	if i >= 0 {
+		line = line[:i]
+	}
+	return strings.TrimSpace(line)
+}
+
+// parseWildcardLine returns the bare domain and a regexp matching it
+// and any of its subdomains for a formatWildcard line such as
+// "*.tracker.example.net".  It returns "", nil if line doesn't
+// contain a wildcard entry.
+func parseWildcardLine(line string) (string, *regexp.Regexp) {
+	line = parseDomainLine(line)
+	if !strings.HasPrefix(line, "*.") {
+		return "", nil
+	}
+
+	domain := line[len("*."):]
+	if domain == "" {
+		return "", nil
+	}
+
+	pattern := regexp.MustCompile(`(^|\.)` + regexp.QuoteMeta(domain) + `$`)
+	return domain, pattern
+}
+
+// parseRegexLine compiles a formatRegex line as an RE2 pattern.  It
+// returns nil for blank lines and "#" comments.
+func parseRegexLine(line string) *regexp.Regexp {
+	line = parseDomainLine(line)
+	if line == "" {
+		return nil
+	}
+
+	pattern, err := regexp.Compile(line)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: invalid regex %q: %s\n", line, err)
+		return nil
+	}
+
+	return pattern
+}
+
+// fetchedList holds the domains and patterns parsed from a single
+// listDesc's contents.
+type fetchedList struct {
+	domains  []string
+	patterns []*regexp.Regexp
+}
+
+// openURL opens url for reading.  A url without a "://" is treated as
+// a local file name; otherwise, if cacheDir is configured, it is
+// fetched through the on-disk cache, honoring maxAge; if cacheDir is
+// empty, it is fetched directly with client.
+func openURL(url string, maxAge time.Duration, client *http.Client) (io.ReadCloser, error) {
+	if !strings.Contains(url, "://") {
+		return os.Open(url)
+	}
+
+	if cacheDir != "" {
+		return fetchCached(url, maxAge, client)
+	}
+
+	res, err := client.Get(url)
+	if err == nil && res.StatusCode != 200 {
+		err = fmt.Errorf("Get \"%s\" returned status %d", url, res.StatusCode)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// fetchList retrieves and parses the contents referred to by desc.
+func fetchList(desc listDesc, client *http.Client) fetchedList {
+	reader, err := openURL(desc.url, desc.maxAge, client)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", err)
+		return fetchedList{}
+	}
+	defer reader.Close()
+
+	var fetched fetchedList
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if desc.allowBlock == allow && strings.HasPrefix(line, dnsholeMarkerLine) {
+			break
+		}
+
+		switch desc.format {
+		case formatHosts:
+			fetched.domains = append(fetched.domains, parseDomains(line, desc.fieldIndex)...)
+		case formatAdblock:
+			if domain := parseAdblockDomain(line); domain != "" {
+				fetched.domains = append(fetched.domains, domain)
+			}
+		case formatDomains:
+			if domain := parseDomainLine(line); domain != "" {
+				fetched.domains = append(fetched.domains, domain)
+			}
+		case formatWildcard:
+			if domain, pattern := parseWildcardLine(line); domain != "" {
+				fetched.domains = append(fetched.domains, domain)
+				fetched.patterns = append(fetched.patterns, pattern)
+			}
+		case formatRegex:
+			if pattern := parseRegexLine(line); pattern != nil {
+				fetched.patterns = append(fetched.patterns, pattern)
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %s: %s\n", desc.url, err)
+		return fetchedList{}
+	}
+
+	return fetched
+}
+
+// matchesAny reports whether domain matches one of patterns.
+func matchesAny(domain string, patterns []*regexp.Regexp) bool {
+	for _, pattern := range patterns {
+		if pattern.MatchString(domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// newHTTPClient returns the http.Client used to fetch remote lists.
+func newHTTPClient() *http.Client {
+	tr := http.DefaultTransport.(*http.Transport)
+	tr.TLSHandshakeTimeout = time.Duration(30) * time.Second
+	tr.ResponseHeaderTimeout = time.Duration(30) * time.Second
+
+	if insecureSSL {
+		tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	return &http.Client{
+		Transport: tr,
+		Timeout:   time.Duration(120) * time.Second,
+	}
+}
+
+// getBlocklistDomains returns a hostEntry for every domain that
+// should appear in the generated output: every rewritten domain (using
+// its configured target), plus every blocklisted domain that isn't
+// allowlisted or rewritten (using the configured block address).  Any
+// wildcard or regex patterns configured among listDescs are applied to
+// the union of all plain-domain entries, so that a catch-all blocklist
+// pattern blocks matching domains without requiring every subdomain to
+// be enumerated explicitly, and a catch-all allowlist pattern exempts
+// matching domains from the blocklist the same way.  Rewrites take
+// precedence over both the allowlist and the blocklist.
+func getBlocklistDomains(client *http.Client, rewrites map[string]string) []hostEntry {
+	fetchedLists := make([]fetchedList, len(listDescs))
+
+	callConcurrently(concurrency, len(listDescs), func(i int) {
+		fetchedLists[i] = fetchList(listDescs[i], client)
+	})
+
+	allowDomainMap := make(map[string]bool)
+	blockDomainMap := make(map[string]bool)
+	var allowPatterns []*regexp.Regexp
+	var blockPatterns []*regexp.Regexp
+
+	for i, fetched := range fetchedLists {
+		switch listDescs[i].allowBlock {
+		case allow:
+			for _, domain := range fetched.domains {
+				allowDomainMap[domain] = true
+			}
+			allowPatterns = append(allowPatterns, fetched.patterns...)
+		case block:
+			for _, domain := range fetched.domains {
+				blockDomainMap[domain] = true
+			}
+			blockPatterns = append(blockPatterns, fetched.patterns...)
+		}
+	}
+
+	if len(blockPatterns) > 0 {
+		candidateMap := make(map[string]bool)
+		for domain := range allowDomainMap {
+			candidateMap[domain] = true
+		}
+		for domain := range blockDomainMap {
+			candidateMap[domain] = true
+		}
+
+		for domain := range candidateMap {
+			if matchesAny(domain, blockPatterns) {
+				blockDomainMap[domain] = true
+			}
+		}
+	}
+
+	entries := make([]hostEntry, 0, len(blockDomainMap)+len(rewrites))
+	for domain, target := range rewrites {
+		entries = append(entries, hostEntry{domain, target})
+	}
+	for domain := range blockDomainMap {
+		if !allowDomainMap[domain] && !matchesAny(domain, allowPatterns) && rewrites[domain] == "" {
+			entries = append(entries, hostEntry{domain, ""})
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].domain < entries[j].domain
+	})
+
+	return entries
+}
@@ -0,0 +1,203 @@
+// Copyright 2020 Dale Farnsworth. All rights reserved.
+
+// Dale Farnsworth
+// 1007 W Mendoza Ave
+// Mesa, AZ  85210
+// USA
+//
+// dale@farnsworth.org
+
+// dnshole is free software: you can redistribute it and/or modify
+// it under the terms of version 3 of the GNU General Public License
+// as published by the Free Software Foundation.
+//
+// dnshole is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with dnshole.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// cacheDir is where fetched remote lists are cached, set by the
+// "cachedir" config directive.  It is empty by default, which
+// disables caching.
+var cacheDir string
+
+// forceRevalidate causes cached lists to always be revalidated with
+// the upstream server, ignoring any "maxage" freshness window.  It is
+// set by the -revalidate flag.
+var forceRevalidate bool
+
+// cacheSidecar is the metadata dnshole keeps alongside each cached
+// list so it can make conditional requests and judge freshness.
+type cacheSidecar struct {
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	SHA256       string    `json:"sha256"`
+	FetchedAt    time.Time `json:"fetched_at"`
+}
+
+// cachePaths returns the cache file and sidecar file names for url.
+func cachePaths(url string) (string, string) {
+	sum := sha256.Sum256([]byte(url))
+	name := hex.EncodeToString(sum[:])
+	path := filepath.Join(cacheDir, name)
+	return path, path + ".json"
+}
+
+// readSidecar loads the cache sidecar for path, returning nil if it
+// doesn't exist or can't be parsed.
+func readSidecar(sidecarPath string) *cacheSidecar {
+	data, err := os.ReadFile(sidecarPath)
+	if err != nil {
+		return nil
+	}
+
+	var sidecar cacheSidecar
+	if err := json.Unmarshal(data, &sidecar); err != nil {
+		return nil
+	}
+
+	return &sidecar
+}
+
+// writeSidecar atomically replaces the cache sidecar for path.
+func writeSidecar(sidecarPath string, sidecar *cacheSidecar) error {
+	data, err := json.Marshal(sidecar)
+	if err != nil {
+		return err
+	}
+
+	return atomicWrite(sidecarPath, data)
+}
+
+// atomicWrite atomically replaces path's contents with data.
+func atomicWrite(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// fetchCached fetches url through the on-disk cache in cacheDir,
+// returning a reader over its contents.  If maxAge is positive and the
+// cached copy is younger than maxAge, it is returned without any
+// network request.  Otherwise a conditional GET is made using the
+// cached ETag/Last-Modified; a 304 response or a failure to reach url
+// falls back to the cached copy.  A 200 response atomically replaces
+// the cached copy and its sidecar.
+func fetchCached(url string, maxAge time.Duration, client *http.Client) (io.ReadCloser, error) {
+	path, sidecarPath := cachePaths(url)
+	sidecar := readSidecar(sidecarPath)
+
+	if sidecar != nil && !forceRevalidate && maxAge > 0 && time.Since(sidecar.FetchedAt) < maxAge {
+		if cached, err := os.Open(path); err == nil {
+			return cached, nil
+		}
+	}
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if sidecar != nil {
+		if sidecar.ETag != "" {
+			req.Header.Set("If-None-Match", sidecar.ETag)
+		}
+		if sidecar.LastModified != "" {
+			req.Header.Set("If-Modified-Since", sidecar.LastModified)
+		}
+	}
+
+	res, fetchErr := client.Do(req)
+	if fetchErr == nil && res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNotModified {
+		fetchErr = fmt.Errorf("Get \"%s\" returned status %d", url, res.StatusCode)
+	}
+
+	if fetchErr != nil {
+		if cached, err := os.Open(path); err == nil {
+			fmt.Fprintf(os.Stderr, "Warning: %s, using cached copy\n", fetchErr)
+			return cached, nil
+		}
+		return nil, fetchErr
+	}
+
+	if res.StatusCode == http.StatusNotModified {
+		res.Body.Close()
+		if sidecar == nil {
+			// No conditional headers were sent, so this 304 is
+			// unexpected; fabricate an empty sidecar rather than
+			// trusting a cached copy we never validated.
+			sidecar = &cacheSidecar{}
+		}
+		sidecar.FetchedAt = time.Now()
+		if err := writeSidecar(sidecarPath, sidecar); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %s\n", err)
+		}
+		return os.Open(path)
+	}
+
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		if cached, cerr := os.Open(path); cerr == nil {
+			fmt.Fprintf(os.Stderr, "Warning: %s, using cached copy\n", err)
+			return cached, nil
+		}
+		return nil, err
+	}
+
+	if err := atomicWrite(path, body); err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(body)
+	newSidecar := &cacheSidecar{
+		ETag:         res.Header.Get("ETag"),
+		LastModified: res.Header.Get("Last-Modified"),
+		SHA256:       hex.EncodeToString(sum[:]),
+		FetchedAt:    time.Now(),
+	}
+	if err := writeSidecar(sidecarPath, newSidecar); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", err)
+	}
+
+	return os.Open(path)
+}
+
+// defaultCacheDir returns the default cachedir: $XDG_CACHE_HOME/dnshole
+// (or the platform equivalent), or "" if it can't be determined, in
+// which case caching stays disabled unless "cachedir" is configured.
+func defaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "dnshole")
+}
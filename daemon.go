@@ -0,0 +1,141 @@
+// Copyright 2020 Dale Farnsworth. All rights reserved.
+
+// Dale Farnsworth
+// 1007 W Mendoza Ave
+// Mesa, AZ  85210
+// USA
+//
+// dale@farnsworth.org
+
+// dnshole is free software: you can redistribute it and/or modify
+// it under the terms of version 3 of the GNU General Public License
+// as published by the Free Software Foundation.
+//
+// dnshole is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with dnshole.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// sdNotify sends a systemd notification message to the socket named
+// by $NOTIFY_SOCKET, if any, implementing the sd_notify datagram
+// protocol directly so dnshole needs neither libsystemd nor cgo.  It
+// is a no-op, returning nil, when $NOTIFY_SOCKET isn't set.
+func sdNotify(state string) error {
+	socketPath := os.Getenv("NOTIFY_SOCKET")
+	if socketPath == "" {
+		return nil
+	}
+
+	// A leading "@" denotes the Linux abstract namespace, spelled
+	// with a leading NUL byte at the socket API level.
+	if socketPath[0] == '@' {
+		socketPath = "\x00" + socketPath[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval returns half of the watchdog interval systemd
+// requested via $WATCHDOG_USEC, or 0 if no watchdog was requested, or
+// $WATCHDOG_PID names a different process.
+func watchdogInterval() time.Duration {
+	usecStr := os.Getenv("WATCHDOG_USEC")
+	if usecStr == "" {
+		return 0
+	}
+
+	if pidStr := os.Getenv("WATCHDOG_PID"); pidStr != "" {
+		pid, err := strconv.Atoi(pidStr)
+		if err != nil || pid != os.Getpid() {
+			return 0
+		}
+	}
+
+	usec, err := strconv.ParseInt(usecStr, 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// refreshDaemon regenerates the hosts file, notifying systemd of the
+// reload around it per the Type=notify-reload protocol.
+func refreshDaemon() {
+	if err := sdNotify("RELOADING=1"); err != nil {
+		log.Printf("sd_notify: %s", err)
+	}
+
+	if err := generate(); err != nil {
+		log.Printf("refresh failed: %s", err)
+		return
+	}
+
+	if err := sdNotify("READY=1"); err != nil {
+		log.Printf("sd_notify: %s", err)
+	}
+}
+
+// runDaemon keeps dnshole resident, regenerating the hosts file on
+// the refreshInterval timer and whenever SIGHUP is received.  A
+// refresh failure is logged and retried on the next tick or signal
+// rather than terminating the daemon.
+func runDaemon() {
+	hups := make(chan os.Signal, 1)
+	signal.Notify(hups, syscall.SIGHUP)
+
+	if err := generate(); err != nil {
+		log.Printf("refresh failed: %s", err)
+	} else if err := sdNotify("READY=1"); err != nil {
+		log.Printf("sd_notify: %s", err)
+	}
+
+	var refreshC <-chan time.Time
+	if refreshInterval > 0 {
+		ticker := time.NewTicker(refreshInterval)
+		defer ticker.Stop()
+		refreshC = ticker.C
+	}
+
+	var watchdogC <-chan time.Time
+	if interval := watchdogInterval(); interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		watchdogC = ticker.C
+	}
+
+	for {
+		select {
+		case <-hups:
+			refreshDaemon()
+		case <-refreshC:
+			refreshDaemon()
+		case <-watchdogC:
+			if err := sdNotify("WATCHDOG=1"); err != nil {
+				log.Printf("sd_notify: %s", err)
+			}
+		}
+	}
+}
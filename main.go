@@ -23,16 +23,11 @@ package main
 
 import (
 	"bufio"
-	"crypto/tls"
 	"flag"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
 	"os"
 	"path/filepath"
-	"regexp"
-	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -47,8 +42,12 @@ const (
 	block
 )
 
+// defaultConcurrency is the maximum number of files/urls to retrieve
+// concurrently when the config file has no "concurrency" directive.
+const defaultConcurrency = 10
+
 // concurrency is the maximum number of files/urls to retrieve concurrently.
-var concurrency int
+var concurrency = defaultConcurrency
 
 // callConcurrently calls fcn count times with at most concurrency
 // instances of fcn running concurrently.
@@ -76,125 +75,6 @@ func callConcurrently(concurrency int, count int, fcn func(int)) {
 	}
 }
 
-// listDesc contains the information needed to fetch and parse a list
-// of domains.
-type listDesc struct {
-	url        string // The url containing the list of domains.
-	fieldIndex int    // The, space separated, index of the domain on a line, origin 1.
-	allowBlock int    // whether the list is a allowlist or a blocklist
-}
-
-// listDescs holds all of the list descripters read from the config file.
-var listDescs []listDesc
-
-// parseDomains returns the domain names from field fieldIndex on a line.
-func parseDomains(line string, fieldIndex int) []string {
-	i := strings.Index(line, "#")
-	if i >= 0 {
-		line = line[:i]
-	}
-
-	fields := strings.Fields(line)
-	if fieldIndex >= len(fields) {
-		return nil
-	}
-	return fields[fieldIndex:]
-}
-
-// getBlocklistDomains returns all of the domain names in the
-// blocklisted urls and not in the allowlisted urls of listDescs.
-func getBlocklistDomains() []string {
-	tr := http.DefaultTransport.(*http.Transport)
-	tr.TLSHandshakeTimeout = time.Duration(30) * time.Second
-	tr.ResponseHeaderTimeout = time.Duration(30) * time.Second
-
-	client := &http.Client{
-		Transport: tr,
-		Timeout:   time.Duration(120) * time.Second,
-	}
-
-	if insecureSSL {
-		tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
-	}
-
-	allowDomainsList := make([][]string, 0)
-	blockDomainsList := make([][]string, 0)
-
-	callConcurrently(concurrency, len(listDescs), func(i int) {
-		url := listDescs[i].url
-		index := listDescs[i].fieldIndex
-		wb := listDescs[i].allowBlock
-
-		var reader io.Reader
-		if !strings.Contains(url, "://") {
-			file, err := os.Open(url)
-			if err != nil {
-				log.Fatal(err)
-			}
-			reader = file
-		} else {
-			res, err := client.Get(url)
-			if err == nil && res.StatusCode != 200 {
-				err = fmt.Errorf("Get \"%s\" returned status %d", url, res.StatusCode)
-			}
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Warning: %s\n", err)
-				return
-			}
-			reader = res.Body
-		}
-		domains := make([]string, 0)
-		scanner := bufio.NewScanner(reader)
-		for scanner.Scan() {
-			line := scanner.Text()
-			if wb == allow {
-				if strings.HasPrefix(line, dnsholeMarkerLine) {
-					break
-				}
-			}
-
-			parsedDomains := parseDomains(line, index)
-			domains = append(domains, parsedDomains...)
-		}
-
-		if err := scanner.Err(); err != nil {
-			log.Fatal(err)
-		}
-
-		switch wb {
-		case allow:
-			allowDomainsList = append(allowDomainsList, domains)
-		case block:
-			blockDomainsList = append(blockDomainsList, domains)
-		}
-	})
-
-	allowDomainMap := make(map[string]bool)
-	for _, domains := range allowDomainsList {
-		for _, domain := range domains {
-			allowDomainMap[domain] = true
-		}
-	}
-
-	blockDomainMap := make(map[string]bool)
-	for _, domains := range blockDomainsList {
-		for _, domain := range domains {
-			if !allowDomainMap[domain] {
-				blockDomainMap[domain] = true
-			}
-		}
-	}
-
-	blockDomains := make([]string, 0)
-	for domain := range blockDomainMap {
-		blockDomains = append(blockDomains, domain)
-	}
-
-	sort.Strings(blockDomains)
-
-	return blockDomains
-}
-
 func sameFile(filenameA, filenameB string) bool {
 	statA, err := os.Stat(filenameA)
 	if err != nil {
@@ -213,135 +93,196 @@ func sameFile(filenameA, filenameB string) bool {
 	return true
 }
 
-// createNewHostsFile copies the original hosts file to newHostsFilename
-// and then adds the new blocklisted domains to it.
-func createNewHostsFile(outputFilename string, domains []string) {
-	var err error
-	host, err := os.Open(hostsFilename)
+// parseFieldIndex parses the origin-1 field index used by the hosts
+// format, returning it as an origin-0 index.
+func parseFieldIndex(field string, filename string, lineCount int) (int, error) {
+	fieldIndex, err := strconv.Atoi(field)
 	if err != nil {
-		log.Fatal(err)
+		return 0, fmt.Errorf("%s:%d: non-numeric field index", filename, lineCount)
 	}
-	defer host.Close()
-
-	var newHost *os.File
-	if outputFilename == "-" {
-		newHost = os.Stdout
-	} else {
-		newHost, err = os.Create(outputFilename)
-		if err != nil {
-			log.Fatal(err)
-		}
-	}
-
-	var lastLine string
-
-	scanner := bufio.NewScanner(host)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.HasPrefix(line, dnsholeMarkerLine) {
-			break
-		}
-		fmt.Fprintln(newHost, line)
-		lastLine = line
+	fieldIndex -= 1
+	if fieldIndex < 0 {
+		return 0, fmt.Errorf("%s:%d: field index must be greater than 0", filename, lineCount)
 	}
+	return fieldIndex, nil
+}
 
-	if err := scanner.Err(); err != nil {
-		log.Fatal(err)
+// extractMaxAge strips an optional trailing "maxage <duration>" pair
+// from fields, returning the remaining fields and the parsed
+// duration, or 0 if fields had no "maxage" suffix.
+func extractMaxAge(fields []string, filename string, lineCount int) ([]string, time.Duration, error) {
+	if len(fields) < 2 || strings.ToLower(fields[len(fields)-2]) != "maxage" {
+		return fields, 0, nil
 	}
 
-	if !blankRE.MatchString(lastLine) {
-		fmt.Fprintln(newHost, "")
+	maxAge, err := time.ParseDuration(fields[len(fields)-1])
+	if err != nil {
+		return nil, 0, fmt.Errorf("%s:%d: invalid duration: %s", filename, lineCount, err)
 	}
 
-	fmt.Fprintln(newHost, dnsholeMarkerLine+" Do not edit this line or following lines.")
-	fmt.Fprintln(newHost, "# They are automatically generated by dnshole.")
-	timeStr := time.Now().Format(" Monday 2006-01-02 15:04:05 MST")
-	fmt.Fprintln(newHost, "# Generated"+timeStr)
-	fmt.Fprintln(newHost, "")
+	return fields[:len(fields)-2], maxAge, nil
+}
 
-	for _, domain := range domains {
-		fmt.Fprintf(newHost, "0.0.0.0 %s\n", domain)
+// appendListDesc parses the remaining fields of an allowlist or
+// blocklist directive and appends the resulting listDesc.  Supported
+// forms, each optionally followed by "maxage <duration>", are:
+//
+//	<index> <url>               (hosts format, deprecated)
+//	hosts <index> <url>
+//	adblock <url>
+//	domains <url>
+//	wildcard <url>
+//	regex <url>
+func appendListDesc(allowBlock int, fields []string, filename string, lineCount int) error {
+	fields, maxAge, err := extractMaxAge(fields, filename, lineCount)
+	if err != nil {
+		return err
 	}
 
-	if err := newHost.Close(); err != nil {
-		log.Fatal(err)
+	if len(fields) < 3 {
+		return fmt.Errorf("%s:%d: wrong number of fields", filename, lineCount)
 	}
-}
 
-var blankRE *regexp.Regexp
+	switch strings.ToLower(fields[1]) {
+	case formatHosts:
+		if len(fields) != 4 {
+			return fmt.Errorf("%s:%d: wrong number of fields", filename, lineCount)
+		}
+		fieldIndex, err := parseFieldIndex(fields[2], filename, lineCount)
+		if err != nil {
+			return err
+		}
+		listDescs = append(listDescs, listDesc{formatHosts, fields[3], fieldIndex, allowBlock, maxAge})
 
-func init() {
-	blankRE = regexp.MustCompile(`^\s*$`)
-}
+	case formatAdblock, formatDomains, formatWildcard, formatRegex:
+		if len(fields) != 3 {
+			return fmt.Errorf("%s:%d: wrong number of fields", filename, lineCount)
+		}
+		format := strings.ToLower(fields[1])
+		listDescs = append(listDescs, listDesc{format, fields[2], 0, allowBlock, maxAge})
 
-func appendListDesc(allowBlock int, fields []string, filename string, lineCount int) {
-	if len(fields) != 3 {
-		log.Fatalf("%s:%d: wrong number of fields\n", filename, lineCount)
-	}
-	fieldIndex, err := strconv.Atoi(fields[1])
-	if err != nil {
-		log.Fatalf("%s:%d: non-numeric field index\n", filename, lineCount)
-	}
-	fieldIndex -= 1
-	if fieldIndex < 0 {
-		log.Fatalf("%s:%d: field index must be greater than 0\n", filename, lineCount)
+	default:
+		// Deprecated form: <index> <url>, implicitly hosts format.
+		if len(fields) != 3 {
+			return fmt.Errorf("%s:%d: wrong number of fields", filename, lineCount)
+		}
+		fieldIndex, err := parseFieldIndex(fields[1], filename, lineCount)
+		if err != nil {
+			return err
+		}
+		listDescs = append(listDescs, listDesc{formatHosts, fields[2], fieldIndex, allowBlock, maxAge})
 	}
-	url := fields[2]
 
-	listDescs = append(listDescs, listDesc{url, fieldIndex, allowBlock})
+	return nil
 }
 
-func processConfigLine(line string, filename string, lineCount int) {
+func processConfigLine(line string, filename string, lineCount int) error {
 	if strings.HasPrefix(line, "#") {
-		return
+		return nil
 	}
 	if blankRE.MatchString(line) {
-		return
+		return nil
 	}
 
 	fields := strings.Fields(line)
 	switch strings.ToLower(fields[0]) {
 	case "allowlist":
-		appendListDesc(allow, fields, filename, lineCount)
+		return appendListDesc(allow, fields, filename, lineCount)
 
 	case "blocklist":
-		appendListDesc(block, fields, filename, lineCount)
+		return appendListDesc(block, fields, filename, lineCount)
+
+	case "rewrite":
+		if len(fields) != 3 {
+			return fmt.Errorf("%s:%d: wrong number of fields", filename, lineCount)
+		}
+		rewriteMap[fields[1]] = fields[2]
+
+	case "rewritelist":
+		fields, maxAge, err := extractMaxAge(fields, filename, lineCount)
+		if err != nil {
+			return err
+		}
+		if len(fields) != 3 {
+			return fmt.Errorf("%s:%d: wrong number of fields", filename, lineCount)
+		}
+		fieldIndex, err := parseFieldIndex(fields[1], filename, lineCount)
+		if err != nil {
+			return err
+		}
+		rewriteListDescs = append(rewriteListDescs, rewriteListDesc{fields[2], fieldIndex, maxAge})
+
+	case "cachedir":
+		if len(fields) != 2 {
+			return fmt.Errorf("%s:%d: wrong number of fields", filename, lineCount)
+		}
+		cacheDir = fields[1]
+
+	case "format":
+		if len(fields) != 2 {
+			return fmt.Errorf("%s:%d: wrong number of fields", filename, lineCount)
+		}
+		outputFormat = strings.ToLower(fields[1])
+
+	case "blockaddress":
+		if len(fields) != 2 && len(fields) != 3 {
+			return fmt.Errorf("%s:%d: wrong number of fields", filename, lineCount)
+		}
+		blockAddressV4 = fields[1]
+		blockAddressV6 = ""
+		if len(fields) == 3 {
+			blockAddressV6 = fields[2]
+		}
+
+	case "refresh":
+		if len(fields) != 2 {
+			return fmt.Errorf("%s:%d: wrong number of fields", filename, lineCount)
+		}
+		interval, err := time.ParseDuration(fields[1])
+		if err != nil {
+			return fmt.Errorf("%s:%d: invalid duration: %s", filename, lineCount, err)
+		}
+		refreshInterval = interval
 
 	case "concurrency":
 		if len(fields) != 2 {
-			log.Fatalf("%s:%d: wrong number of fields\n", filename, lineCount)
+			return fmt.Errorf("%s:%d: wrong number of fields", filename, lineCount)
 		}
-		var err error
-		concurrency, err = strconv.Atoi(fields[1])
+		n, err := strconv.Atoi(fields[1])
 		if err != nil {
-			log.Fatalf("%s:%d: non-numeric concurrency\n", filename, lineCount)
+			return fmt.Errorf("%s:%d: non-numeric concurrency", filename, lineCount)
 		}
+		concurrency = n
 
 	default:
-		log.Fatalf("%s:%d: unknown directive: %s\n", filename, lineCount, fields[0])
+		return fmt.Errorf("%s:%d: unknown directive: %s", filename, lineCount, fields[0])
 	}
 
+	return nil
 }
 
-func readConfigFile(filename string) {
-	config, err := os.Open(configFilename)
+func readConfigFile(filename string) error {
+	config, err := os.Open(filename)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer config.Close()
 
 	listDescs = make([]listDesc, 0)
+	rewriteListDescs = make([]rewriteListDesc, 0)
+	rewriteMap = make(map[string]string)
+	cacheDir = defaultCacheDir()
 
 	lineCounter := 1
 	scanner := bufio.NewScanner(config)
 	for scanner.Scan() {
-		processConfigLine(scanner.Text(), filename, lineCounter)
+		if err := processConfigLine(scanner.Text(), filename, lineCounter); err != nil {
+			return err
+		}
 		lineCounter += 1
 	}
 
-	if err := scanner.Err(); err != nil {
-		log.Fatal(err)
-	}
+	return scanner.Err()
 }
 
 var configFilename string
@@ -349,6 +290,18 @@ var hostsFilename string
 var outputFilename string
 var wantHelp bool
 var insecureSSL bool
+var daemonMode bool
+
+// blockAddressV4 and blockAddressV6 are the addresses written for a
+// blocked domain that has no rewrite target.  blockAddressV6 is only
+// emitted when configured via the "blockaddress" directive.
+var blockAddressV4 = "0.0.0.0"
+var blockAddressV6 = ""
+
+// refreshInterval is how often -daemon mode regenerates the hosts
+// file, set by the "refresh" config directive.  Zero disables the
+// timer, leaving SIGHUP as the only way to trigger a refresh.
+var refreshInterval time.Duration
 
 func init() {
 	log.SetPrefix(filepath.Base(os.Args[0]) + ": ")
@@ -378,6 +331,24 @@ func init() {
 		"Output file name, \"-\" means stdout (default is <hosts_filename>)",
 	)
 
+	flag.BoolVar(&daemonMode,
+		"daemon",
+		false,
+		"Stay resident, regenerating the hosts file on the \"refresh\" interval and on SIGHUP",
+	)
+
+	flag.BoolVar(&forceRevalidate,
+		"revalidate",
+		false,
+		"Revalidate every cached list with its source instead of trusting \"maxage\"",
+	)
+
+	flag.StringVar(&outputFormat,
+		"format",
+		outputHosts,
+		"Output format: hosts, dnsmasq, unbound, rpz, corefile-hosts",
+	)
+
 	flag.Usage = func() {
 		_, _ = fmt.Fprintf(os.Stderr,
 			"Usage: %s: [flags] <hosts_filename>\n",
@@ -389,6 +360,64 @@ func init() {
 	}
 }
 
+// generate reads the config file, fetches the allow/block/rewrite
+// lists, and (re)writes the hosts file.  It is the one-shot behavior
+// of dnshole, and is also what -daemon mode calls on every refresh.
+func generate() error {
+	if err := readConfigFile(configFilename); err != nil {
+		return err
+	}
+
+	if cacheDir != "" {
+		if err := os.MkdirAll(cacheDir, 0700); err != nil {
+			return err
+		}
+	}
+
+	// allowlist the domains already in the hosts file
+	listDescs = append(listDescs, listDesc{formatHosts, hostsFilename, 1, allow, 0})
+
+	client := newHTTPClient()
+	rewrites := getRewrites(client)
+	entries := getBlocklistDomains(client, rewrites)
+
+	writer, err := newOutputWriter(outputFormat)
+	if err != nil {
+		return err
+	}
+
+	out := outputFilename
+	if !isHostsFamilyFormat(outputFormat) {
+		if sameFile(hostsFilename, out) {
+			return fmt.Errorf("-output must be given and differ from the hosts file when -format is %q", outputFormat)
+		}
+		return writer.write(out, entries)
+	}
+
+	if sameFile(hostsFilename, out) {
+		dir := filepath.Dir(hostsFilename)
+		out = filepath.Join(dir, "dnshole_tmp_hosts")
+		if err := writer.write(out, entries); err != nil {
+			return err
+		}
+		return os.Rename(out, hostsFilename)
+	}
+
+	return writer.write(out, entries)
+}
+
+// isHostsFamilyFormat reports whether format merges its output into
+// (or alongside) the original hosts file contents, as opposed to
+// overwriting outputFilename wholesale as a standalone zone file.
+func isHostsFamilyFormat(format string) bool {
+	switch format {
+	case outputHosts, outputCorefileHosts:
+		return true
+	default:
+		return false
+	}
+}
+
 func main() {
 	flag.Parse()
 
@@ -402,19 +431,12 @@ func main() {
 		outputFilename = hostsFilename
 	}
 
-	readConfigFile(configFilename)
-
-	// allowlist the domains already in the hosts file
-	listDescs = append(listDescs, listDesc{hostsFilename, 2, allow})
-
-	domains := getBlocklistDomains()
+	if daemonMode {
+		runDaemon()
+		return
+	}
 
-	if !sameFile(hostsFilename, outputFilename) {
-		createNewHostsFile(outputFilename, domains)
-	} else {
-		dir := filepath.Dir(hostsFilename)
-		outputFilename = filepath.Join(dir, "dnshole_tmp_hosts")
-		createNewHostsFile(outputFilename, domains)
-		os.Rename(outputFilename, hostsFilename)
+	if err := generate(); err != nil {
+		log.Fatal(err)
 	}
 }
@@ -0,0 +1,338 @@
+// Copyright 2020 Dale Farnsworth. All rights reserved.
+
+// Dale Farnsworth
+// 1007 W Mendoza Ave
+// Mesa, AZ  85210
+// USA
+//
+// dale@farnsworth.org
+
+// dnshole is free software: you can redistribute it and/or modify
+// it under the terms of version 3 of the GNU General Public License
+// as published by the Free Software Foundation.
+//
+// dnshole is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with dnshole.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The recognized output formats, selected by the "format" config
+// directive or the -format flag.
+const (
+	outputHosts         = "hosts"
+	outputDnsmasq       = "dnsmasq"
+	outputUnbound       = "unbound"
+	outputRPZ           = "rpz"
+	outputCorefileHosts = "corefile-hosts"
+)
+
+// outputFormat selects which OutputWriter generate uses, set by the
+// "format" config directive or the -format flag.
+var outputFormat = outputHosts
+
+// hostEntry is a single domain to be added to the generated output,
+// either blocked or rewritten to target.
+type hostEntry struct {
+	domain string
+	target string // rewrite target, or "" to use the configured block address(es)
+}
+
+// OutputWriter generates an output file of a particular format from
+// entries.
+type OutputWriter interface {
+	write(outputFilename string, entries []hostEntry) error
+}
+
+// newOutputWriter returns the OutputWriter for the named format.
+func newOutputWriter(format string) (OutputWriter, error) {
+	switch format {
+	case outputHosts:
+		return hostsWriter{}, nil
+	case outputDnsmasq:
+		return dnsmasqWriter{}, nil
+	case outputUnbound:
+		return unboundWriter{}, nil
+	case outputRPZ:
+		return rpzWriter{}, nil
+	case outputCorefileHosts:
+		return corefileHostsWriter{}, nil
+	default:
+		return nil, fmt.Errorf("unknown output format: %s", format)
+	}
+}
+
+var blankRE *regexp.Regexp
+
+func init() {
+	blankRE = regexp.MustCompile(`^\s*$`)
+}
+
+// hostsLine returns the "<address> <domain>" line(s) an entry
+// contributes to a hosts-syntax output.
+func hostsLine(entry hostEntry) []string {
+	if entry.target != "" {
+		return []string{fmt.Sprintf("%s %s", entry.target, entry.domain)}
+	}
+
+	lines := []string{fmt.Sprintf("%s %s", blockAddressV4, entry.domain)}
+	if blockAddressV6 != "" {
+		lines = append(lines, fmt.Sprintf("%s %s", blockAddressV6, entry.domain))
+	}
+	return lines
+}
+
+// writeHostsFamily copies hostsFilename's contents up to the dnshole
+// marker line (if any) to outputFilename, then appends a freshly
+// generated marker section built from entries by lineFormatter.  It
+// implements the shared marker-section preserve/replace convention
+// used by every hosts-syntax output format.
+func writeHostsFamily(outputFilename string, entries []hostEntry, lineFormatter func(hostEntry) []string) error {
+	host, err := os.Open(hostsFilename)
+	if err != nil {
+		return err
+	}
+	defer host.Close()
+
+	var newHost *os.File
+	if outputFilename == "-" {
+		newHost = os.Stdout
+	} else {
+		newHost, err = os.Create(outputFilename)
+		if err != nil {
+			return err
+		}
+	}
+
+	var lastLine string
+
+	scanner := bufio.NewScanner(host)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, dnsholeMarkerLine) {
+			break
+		}
+		fmt.Fprintln(newHost, line)
+		lastLine = line
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	if !blankRE.MatchString(lastLine) {
+		fmt.Fprintln(newHost, "")
+	}
+
+	fmt.Fprintln(newHost, dnsholeMarkerLine+" Do not edit this line or following lines.")
+	fmt.Fprintln(newHost, "# They are automatically generated by dnshole.")
+	timeStr := time.Now().Format(" Monday 2006-01-02 15:04:05 MST")
+	fmt.Fprintln(newHost, "# Generated"+timeStr)
+	fmt.Fprintln(newHost, "")
+
+	for _, entry := range entries {
+		for _, line := range lineFormatter(entry) {
+			fmt.Fprintln(newHost, line)
+		}
+	}
+
+	if newHost == os.Stdout {
+		return nil
+	}
+	return newHost.Close()
+}
+
+// writeZoneFile atomically replaces outputFilename's entire contents
+// with header followed by lines.  It implements the "simply overwrite
+// the file atomically" convention used by the zone-style output
+// formats, which have no original file content to preserve.
+func writeZoneFile(outputFilename string, header []string, lines []string) error {
+	var buf bytes.Buffer
+	for _, line := range header {
+		fmt.Fprintln(&buf, line)
+	}
+	for _, line := range lines {
+		fmt.Fprintln(&buf, line)
+	}
+
+	if outputFilename == "-" {
+		_, err := os.Stdout.Write(buf.Bytes())
+		return err
+	}
+
+	return atomicWrite(outputFilename, buf.Bytes())
+}
+
+// hostsWriter generates the traditional /etc/hosts syntax, blocked
+// and rewritten domains mixed in among the lines copied from
+// hostsFilename.
+type hostsWriter struct{}
+
+func (hostsWriter) write(outputFilename string, entries []hostEntry) error {
+	return writeHostsFamily(outputFilename, entries, hostsLine)
+}
+
+// corefileHostsWriter generates a hosts-syntax snippet meant to be
+// referenced by CoreDNS's "hosts" plugin.
+type corefileHostsWriter struct{}
+
+func (corefileHostsWriter) write(outputFilename string, entries []hostEntry) error {
+	return writeHostsFamily(outputFilename, entries, hostsLine)
+}
+
+// dnsmasqWriter generates "address=/domain/address" lines suitable
+// for dropping into dnsmasq's conf-dir.
+type dnsmasqWriter struct{}
+
+func (dnsmasqWriter) write(outputFilename string, entries []hostEntry) error {
+	header := []string{
+		"# Generated by dnshole.  Place in a directory named by dnsmasq's",
+		"# conf-dir option.",
+		"#",
+		"# Generated" + time.Now().Format(" Monday 2006-01-02 15:04:05 MST"),
+		"",
+	}
+
+	var lines []string
+	for _, entry := range entries {
+		if entry.target != "" {
+			lines = append(lines, fmt.Sprintf("address=/%s/%s", entry.domain, entry.target))
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("address=/%s/%s", entry.domain, blockAddressV4))
+		if blockAddressV6 != "" {
+			lines = append(lines, fmt.Sprintf("address=/%s/%s", entry.domain, blockAddressV6))
+		}
+	}
+
+	return writeZoneFile(outputFilename, header, lines)
+}
+
+// unboundWriter generates Unbound "local-zone"/"local-data" directives
+// suitable for inclusion via Unbound's include: option.
+type unboundWriter struct{}
+
+func (unboundWriter) write(outputFilename string, entries []hostEntry) error {
+	header := []string{
+		"# Generated by dnshole.  Include from unbound.conf's server:",
+		"# clause.",
+		"#",
+		"# Generated" + time.Now().Format(" Monday 2006-01-02 15:04:05 MST"),
+		"",
+	}
+
+	var lines []string
+	for _, entry := range entries {
+		if entry.target == "" {
+			lines = append(lines, fmt.Sprintf("local-zone: %q always_nxdomain", entry.domain))
+			continue
+		}
+
+		lines = append(lines, fmt.Sprintf("local-zone: %q redirect", entry.domain))
+		if ip := net.ParseIP(entry.target); ip != nil {
+			rrtype := "A"
+			if ip.To4() == nil {
+				rrtype = "AAAA"
+			}
+			lines = append(lines, fmt.Sprintf("local-data: %q", entry.domain+" "+rrtype+" "+entry.target))
+		} else {
+			lines = append(lines, fmt.Sprintf("local-data: %q", entry.domain+" CNAME "+entry.target+"."))
+		}
+	}
+
+	return writeZoneFile(outputFilename, header, lines)
+}
+
+// rpzWriter generates a BIND Response Policy Zone file, redirecting
+// blocked domains to NXDOMAIN and rewritten domains to their target
+// via CNAME.
+type rpzWriter struct{}
+
+// previousRPZSerial returns the serial field of outputFilename's
+// existing SOA record, or "" if the file doesn't exist, isn't an RPZ
+// zone file, or outputFilename is "-".
+func previousRPZSerial(outputFilename string) string {
+	if outputFilename == "-" {
+		return ""
+	}
+
+	f, err := os.Open(outputFilename)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.Contains(line, "; serial") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) > 0 {
+			return fields[0]
+		}
+	}
+
+	return ""
+}
+
+// nextRPZSerial returns the YYYYMMDDnn serial to use for
+// outputFilename's next SOA record.  It increments nn if
+// outputFilename's existing serial is already stamped with today's
+// date, so that repeated same-day regenerations bump the serial
+// rather than repeating it; otherwise nn resets to 01.
+func nextRPZSerial(outputFilename string) string {
+	today := time.Now().Format("20060102")
+
+	prev := previousRPZSerial(outputFilename)
+	if len(prev) == 10 && prev[:8] == today {
+		if n, err := strconv.Atoi(prev[8:]); err == nil && n < 99 {
+			return fmt.Sprintf("%s%02d", today, n+1)
+		}
+	}
+
+	return today + "01"
+}
+
+func (rpzWriter) write(outputFilename string, entries []hostEntry) error {
+	serial := nextRPZSerial(outputFilename)
+	header := []string{
+		"$TTL 3600",
+		"@ IN SOA localhost. admin.localhost. (",
+		"\t\t\t" + serial + " ; serial",
+		"\t\t\t3600       ; refresh",
+		"\t\t\t600        ; retry",
+		"\t\t\t86400      ; expire",
+		"\t\t\t3600 )     ; minimum",
+		"\tIN NS localhost.",
+		"",
+	}
+
+	var lines []string
+	for _, entry := range entries {
+		if entry.target == "" {
+			lines = append(lines, fmt.Sprintf("%s CNAME .", entry.domain))
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s CNAME %s.", entry.domain, entry.target))
+	}
+
+	return writeZoneFile(outputFilename, header, lines)
+}
@@ -0,0 +1,113 @@
+// Copyright 2020 Dale Farnsworth. All rights reserved.
+
+// Dale Farnsworth
+// 1007 W Mendoza Ave
+// Mesa, AZ  85210
+// USA
+//
+// dale@farnsworth.org
+
+// dnshole is free software: you can redistribute it and/or modify
+// it under the terms of version 3 of the GNU General Public License
+// as published by the Free Software Foundation.
+//
+// dnshole is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with dnshole.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// rewriteMap holds the domain to target mappings added directly by
+// "rewrite" directives in the config file.
+var rewriteMap = make(map[string]string)
+
+// rewriteListDesc contains the information needed to fetch and parse
+// a bulk rewrite list added by a "rewritelist" directive.
+type rewriteListDesc struct {
+	url        string        // The url containing the rewrite list.
+	fieldIndex int           // The, space separated, index of the target on a line, origin 1.
+	maxAge     time.Duration // cache freshness override; 0 means always revalidate
+}
+
+// rewriteListDescs holds all of the rewriteListDescs read from the
+// config file.
+var rewriteListDescs []rewriteListDesc
+
+// parseRewriteLine returns the target and the domains that should be
+// rewritten to it from field fieldIndex onward on a line.
+func parseRewriteLine(line string, fieldIndex int) (string, []string) {
+	i := strings.Index(line, "#")
+	if i >= 0 {
+		line = line[:i]
+	}
+
+	fields := strings.Fields(line)
+	if fieldIndex >= len(fields)-1 {
+		return "", nil
+	}
+	return fields[fieldIndex], fields[fieldIndex+1:]
+}
+
+// fetchRewriteList retrieves and parses the contents referred to by desc,
+// returning a map from domain to rewrite target.
+func fetchRewriteList(desc rewriteListDesc, client *http.Client) map[string]string {
+	reader, err := openURL(desc.url, desc.maxAge, client)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", err)
+		return nil
+	}
+	defer reader.Close()
+
+	rewrites := make(map[string]string)
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		target, domains := parseRewriteLine(scanner.Text(), desc.fieldIndex)
+		for _, domain := range domains {
+			rewrites[domain] = target
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", err)
+	}
+
+	return rewrites
+}
+
+// getRewrites returns the combined domain to target map from every
+// "rewritelist" bulk import and every directly configured "rewrite"
+// directive.  Directly configured rewrites take precedence over
+// bulk-imported ones.
+func getRewrites(client *http.Client) map[string]string {
+	fetchedMaps := make([]map[string]string, len(rewriteListDescs))
+
+	callConcurrently(concurrency, len(rewriteListDescs), func(i int) {
+		fetchedMaps[i] = fetchRewriteList(rewriteListDescs[i], client)
+	})
+
+	rewrites := make(map[string]string)
+	for _, fetched := range fetchedMaps {
+		for domain, target := range fetched {
+			rewrites[domain] = target
+		}
+	}
+
+	for domain, target := range rewriteMap {
+		rewrites[domain] = target
+	}
+
+	return rewrites
+}